@@ -0,0 +1,42 @@
+package pipline
+
+/*
+#include "pipeline.h"
+*/
+import "C"
+import "unsafe"
+
+// cgoAllocs tracks the argv/envp arrays and the argument strings within them
+// that a single RunWithIO or Start call allocates in C, so they can all be
+// released with one pipeline_free_all call, instead of leaking or needing a
+// matching C.free at each call site. CommandNodes are not tracked here;
+// free_pipeline releases them.
+type cgoAllocs struct {
+	ptrs []unsafe.Pointer
+}
+
+func newCgoAllocs() *cgoAllocs {
+	return &cgoAllocs{}
+}
+
+// addCString registers a C.CString allocation and returns it unchanged, so
+// callers can wrap the allocating call directly: allocs.addCString(C.CString(s)).
+func (a *cgoAllocs) addCString(cstr *C.char) *C.char {
+	a.ptrs = append(a.ptrs, unsafe.Pointer(cstr))
+	return cstr
+}
+
+// addArgv registers a pipeline_alloc_argv allocation and returns it unchanged.
+func (a *cgoAllocs) addArgv(argv **C.char) **C.char {
+	a.ptrs = append(a.ptrs, unsafe.Pointer(argv))
+	return argv
+}
+
+// free releases every tracked allocation via a single pipeline_free_all call.
+// Safe to call on a cgoAllocs that never allocated anything.
+func (a *cgoAllocs) free() {
+	if len(a.ptrs) == 0 {
+		return
+	}
+	C.pipeline_free_all((*unsafe.Pointer)(unsafe.Pointer(&a.ptrs[0])), C.int(len(a.ptrs)))
+}
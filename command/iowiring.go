@@ -0,0 +1,114 @@
+package pipline
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// ioWiring turns Go io.Reader/io.Writer values into file descriptors that
+// can be handed to the C pipeline runner, using os.Pipe plus a copying
+// goroutine for anything that isn't already backed by an *os.File.
+type ioWiring struct {
+	files []*os.File
+	// parentWriteEnds holds this process's own copy of each writerFd pipe's
+	// write end. They must be closed once the pipeline's children have
+	// exited (closing their dup'd copies) so the draining goroutines below
+	// observe EOF instead of blocking forever.
+	parentWriteEnds []*os.File
+	wg              sync.WaitGroup
+	errs            []error
+	mu              sync.Mutex
+}
+
+func newIOWiring() *ioWiring {
+	return &ioWiring{}
+}
+
+// readerFd returns a file descriptor that, when read, yields r's contents.
+// Returns -1 if r is nil.
+func (w *ioWiring) readerFd(r io.Reader) (int, error) {
+	if r == nil {
+		return -1, nil
+	}
+
+	if f, ok := r.(*os.File); ok {
+		return int(f.Fd()), nil
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return -1, err
+	}
+	w.files = append(w.files, pr, pw)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer pw.Close()
+		if _, err := io.Copy(pw, r); err != nil {
+			w.addErr(err)
+		}
+	}()
+
+	return int(pr.Fd()), nil
+}
+
+// writerFd returns a file descriptor that, when written to, forwards the
+// data to w. Returns -1 if out is nil.
+func (w *ioWiring) writerFd(out io.Writer) (int, error) {
+	if out == nil {
+		return -1, nil
+	}
+
+	if f, ok := out.(*os.File); ok {
+		return int(f.Fd()), nil
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return -1, err
+	}
+	w.files = append(w.files, pr, pw)
+	w.parentWriteEnds = append(w.parentWriteEnds, pw)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer pr.Close()
+		if _, err := io.Copy(out, pr); err != nil {
+			w.addErr(err)
+		}
+	}()
+
+	return int(pw.Fd()), nil
+}
+
+func (w *ioWiring) addErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.errs = append(w.errs, err)
+}
+
+// wait closes this process's own copy of every writerFd pipe's write end
+// (the pipeline's children have exited by the time this is called, so that's
+// the last copy left open) and then blocks until every copying goroutine has
+// drained its pipe.
+func (w *ioWiring) wait() error {
+	for _, pw := range w.parentWriteEnds {
+		pw.Close()
+	}
+	w.wg.Wait()
+	if len(w.errs) > 0 {
+		return w.errs[0]
+	}
+	return nil
+}
+
+// close releases every pipe fd created by this wiring. Safe to call multiple
+// times; intended to run via defer alongside wait.
+func (w *ioWiring) close() {
+	for _, f := range w.files {
+		f.Close()
+	}
+}
@@ -1,23 +1,56 @@
 package pipline
 
 /*
-#cgo LDFLAGS: -L. -lpipeline
 #include "pipeline.h"
 */
 import "C"
 import (
+	"context"
 	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
 	"unsafe"
 )
 
+// defaultCancelGracePeriod is how long RunWithIO waits after sending SIGTERM
+// to a canceled pipeline's process group before escalating to SIGKILL.
+const defaultCancelGracePeriod = 5 * time.Second
+
 // Command represents a command in the pipeline.
 type Command struct {
-	args []string
+	args   []string
+	env    []string
+	stdin  io.Reader
+	stderr io.Writer
 }
 
 // Pipeline represents a sequence of commands.
 type Pipeline struct {
-	commands []*Command
+	commands    []*Command
+	pipeFail    bool
+	cancelGrace time.Duration
+
+	// stdoutPipeW and stderrPipeW are the write ends of the pipes created by
+	// StdoutPipe/StderrPipe, handed to the last command's stdout/stderr by
+	// Start. Closed by Start itself once the pipeline's children have forked
+	// and dup'd their own copies.
+	stdoutPipeW *os.File
+	stderrPipeW *os.File
+
+	proc *runningPipeline
+}
+
+// runningPipeline holds the state of a Start call that Wait needs to finish
+// the pipeline off. Exists only between Start and Wait.
+type runningPipeline struct {
+	allocs     *cgoAllocs
+	w          *ioWiring
+	cCommands  []*C.CommandNode
+	pgid       C.int
+	ctx        context.Context
+	cancelDone chan struct{}
 }
 
 // NewCommand creates a new Command with the given arguments.
@@ -25,6 +58,28 @@ func NewCommand(args []string) *Command {
 	return &Command{args: args}
 }
 
+// SetStdin feeds r to this command's stdin, overriding whatever the
+// previous stage in the pipeline would otherwise have piped into it (or, for
+// the first command, the stdin passed to RunWithIO).
+func (c *Command) SetStdin(r io.Reader) *Command {
+	c.stdin = r
+	return c
+}
+
+// SetStderr redirects this command's stderr to w instead of the pipeline's
+// shared stderr.
+func (c *Command) SetStderr(w io.Writer) *Command {
+	c.stderr = w
+	return c
+}
+
+// SetEnv sets this command's environment as "KEY=VALUE" pairs. If unset, the
+// command inherits the calling process's environment.
+func (c *Command) SetEnv(env []string) *Command {
+	c.env = env
+	return c
+}
+
 // NewPipeline creates a new Pipeline.
 func NewPipeline() *Pipeline {
 	return &Pipeline{}
@@ -36,38 +91,361 @@ func (p *Pipeline) AddCommand(cmd *Command) *Pipeline {
 	return p
 }
 
+// SetPipeFail controls how RunWithIO (and Run) decide whether the pipeline
+// failed. When true, the pipeline fails if any command exits non-zero
+// (bash's `set -o pipefail`); when false (the default), only the last
+// command's exit status matters.
+func (p *Pipeline) SetPipeFail(pipeFail bool) *Pipeline {
+	p.pipeFail = pipeFail
+	return p
+}
+
+// SetCancelGracePeriod controls how long RunWithIO waits after sending
+// SIGTERM to a canceled pipeline's process group before escalating to
+// SIGKILL. Defaults to 5 seconds.
+func (p *Pipeline) SetCancelGracePeriod(d time.Duration) *Pipeline {
+	p.cancelGrace = d
+	return p
+}
+
+func (p *Pipeline) cancelGracePeriod() time.Duration {
+	if p.cancelGrace > 0 {
+		return p.cancelGrace
+	}
+	return defaultCancelGracePeriod
+}
+
+// StdoutPipe returns a pipe connected to the last command's stdout. The
+// pipeline does not start writing to it until Start is called, and the
+// returned pipe should be read to EOF before calling Wait, as with
+// os/exec.Cmd.StdoutPipe. Unlike os/exec, Wait does not close the returned
+// pipe; the caller closes it. It's an error to call StdoutPipe after Start,
+// or more than once.
+func (p *Pipeline) StdoutPipe() (io.ReadCloser, error) {
+	if p.proc != nil {
+		return nil, errors.New("pipeline: StdoutPipe called after Start")
+	}
+	if p.stdoutPipeW != nil {
+		return nil, errors.New("pipeline: StdoutPipe called twice")
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stdoutPipeW = pw
+	return pr, nil
+}
+
+// StderrPipe is StdoutPipe for the last command's stderr.
+func (p *Pipeline) StderrPipe() (io.ReadCloser, error) {
+	if p.proc != nil {
+		return nil, errors.New("pipeline: StderrPipe called after Start")
+	}
+	if p.stderrPipeW != nil {
+		return nil, errors.New("pipeline: StderrPipe called twice")
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stderrPipeW = pw
+	return pr, nil
+}
+
 // Run executes the pipeline and captures the output of the last command.
 // Redirect stdout to outputFd. If its -1, output is not redirected.
-func (p *Pipeline) Run(outputFd int) error {
-	if len(p.commands) == 0 {
-		return errors.New("no commands in pipeline")
+func (p *Pipeline) Run(outputFd int) (*PipelineResult, error) {
+	var stdout io.Writer
+	if outputFd >= 0 {
+		stdout = os.NewFile(uintptr(outputFd), "pipeline-output")
 	}
+	return p.RunWithIO(context.Background(), nil, stdout, nil)
+}
 
-	// Convert Go commands to C commands
-	cCommands := make([]*C.CommandNode, len(p.commands))
-	for i, cmd := range p.commands {
-		// Convert Go []string to C char**
-		cArgs := make([]*C.char, len(cmd.args)+1)
-		for j, arg := range cmd.args {
-			cArgs[j] = C.CString(arg)
-		}
-		cArgs[len(cmd.args)] = nil // NULL-terminate the array
+// RunContext is Run plus cancellation: if ctx is done before the pipeline
+// finishes, every command in it (they all share one process group) is sent
+// SIGTERM, escalating to SIGKILL after SetCancelGracePeriod elapses.
+func (p *Pipeline) RunContext(ctx context.Context, outputFd int) (*PipelineResult, error) {
+	var stdout io.Writer
+	if outputFd >= 0 {
+		stdout = os.NewFile(uintptr(outputFd), "pipeline-output")
+	}
+	return p.RunWithIO(ctx, nil, stdout, nil)
+}
+
+// RunWithIO executes the pipeline, feeding stdin to the first command and
+// capturing the last command's stdout and stderr. Any of stdin, stdout or
+// stderr may be nil, in which case that stream is left connected to the
+// calling process's own stdin/stdout/stderr.
+//
+// The returned *PipelineResult is always populated, even when the error is
+// non-nil, so callers can inspect every command's exit status. The error is
+// a *ExitError when the pipeline itself ran but failed per SetPipeFail's
+// semantics.
+//
+// RunWithIO errors immediately if StdoutPipe or StderrPipe was called on p:
+// that output already has a dedicated reader, so continue with Start/Wait
+// instead of Run/RunWithIO.
+func (p *Pipeline) RunWithIO(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (*PipelineResult, error) {
+	if p.stdoutPipeW != nil || p.stderrPipeW != nil {
+		return nil, errors.New("pipeline: StdoutPipe/StderrPipe was called; use Start/Wait instead of Run/RunWithIO")
+	}
 
-		// Create a C CommandNode
-		cCommands[i] = C.create_command_node((**C.char)(unsafe.Pointer(&cArgs[0])))
+	w := newIOWiring()
+	defer w.close()
+
+	pipelineStdinFd, err := w.readerFd(stdin)
+	if err != nil {
+		return nil, err
+	}
+	pipelineStdoutFd, err := w.writerFd(stdout)
+	if err != nil {
+		return nil, err
+	}
+	pipelineStderrFd, err := w.writerFd(stderr)
+	if err != nil {
+		return nil, err
 	}
 
-	// NULL-terminate the array of C CommandNode pointers
-	cCommands = append(cCommands, nil)
+	allocs := newCgoAllocs()
+	defer allocs.free()
+
+	cCommands, err := p.buildCommandNodes(allocs, w)
+	if err != nil {
+		return nil, err
+	}
 
-	// Build the pipeline
 	C.build_pipeline((**C.CommandNode)(unsafe.Pointer(&cCommands[0])))
 
-	// Execute the pipeline
-	C.execute_pipeline(cCommands[0], C.int(outputFd))
+	// Start the pipeline. All of its commands share one process group, so a
+	// canceled ctx can terminate the whole thing with a single signal.
+	pgid := C.execute_pipeline_start(cCommands[0], C.int(pipelineStdinFd), C.int(pipelineStdoutFd), C.int(pipelineStderrFd))
+	if pgid == -1 {
+		C.free_pipeline(cCommands[0])
+		// Unblock and wait out the io-copy goroutines before returning, so
+		// they're not still reading/writing the caller's buffers afterward.
+		w.wait()
+		return nil, errors.New("pipeline: failed to start")
+	}
+
+	ctx, cancelDone := p.watchCancellation(ctx, pgid)
+
+	cStatuses := make([]C.CommandStatus, len(p.commands))
+	C.execute_pipeline_wait(cCommands[0], (*C.CommandStatus)(unsafe.Pointer(&cStatuses[0])))
+	close(cancelDone)
 
 	// Free the C CommandNodes
 	C.free_pipeline(cCommands[0])
 
+	wiringErr := w.wait()
+
+	return p.collectResult(cStatuses, ctx, wiringErr)
+}
+
+// Start begins running the pipeline and returns immediately, without
+// waiting for it to finish. stdin, if non-nil, is fed to the first command.
+// The last command's stdout and stderr go to whatever StdoutPipe/StderrPipe
+// returned, or are left connected to the calling process's own stdout/stderr
+// if those weren't called. Every started pipeline must be followed by
+// exactly one call to Wait to release the resources Start allocates.
+func (p *Pipeline) Start(ctx context.Context, stdin io.Reader) error {
+	if p.proc != nil {
+		return errors.New("pipeline: already started")
+	}
+
+	w := newIOWiring()
+	stdinFd, err := w.readerFd(stdin)
+	if err != nil {
+		w.close()
+		return err
+	}
+
+	stdoutFd := -1
+	if p.stdoutPipeW != nil {
+		stdoutFd = int(p.stdoutPipeW.Fd())
+	}
+	stderrFd := -1
+	if p.stderrPipeW != nil {
+		stderrFd = int(p.stderrPipeW.Fd())
+	}
+
+	allocs := newCgoAllocs()
+	cCommands, err := p.buildCommandNodes(allocs, w)
+	if err != nil {
+		allocs.free()
+		w.close()
+		return err
+	}
+
+	C.build_pipeline((**C.CommandNode)(unsafe.Pointer(&cCommands[0])))
+
+	pgid := C.execute_pipeline_start(cCommands[0], C.int(stdinFd), C.int(stdoutFd), C.int(stderrFd))
+
+	// The children have their own dup'd copies of the pipe fds now, so the
+	// parent's copies must close for a StdoutPipe/StderrPipe reader to ever
+	// see EOF.
+	if p.stdoutPipeW != nil {
+		p.stdoutPipeW.Close()
+		p.stdoutPipeW = nil
+	}
+	if p.stderrPipeW != nil {
+		p.stderrPipeW.Close()
+		p.stderrPipeW = nil
+	}
+
+	if pgid == -1 {
+		C.free_pipeline(cCommands[0])
+		allocs.free()
+		// Unblock and wait out the io-copy goroutines before returning, so
+		// they're not still reading/writing the caller's buffers afterward.
+		w.wait()
+		w.close()
+		return errors.New("pipeline: failed to start")
+	}
+
+	ctx, cancelDone := p.watchCancellation(ctx, pgid)
+	p.proc = &runningPipeline{
+		allocs:     allocs,
+		w:          w,
+		cCommands:  cCommands,
+		pgid:       pgid,
+		ctx:        ctx,
+		cancelDone: cancelDone,
+	}
 	return nil
 }
+
+// Wait blocks until a pipeline started with Start finishes, then releases
+// every resource Start allocated. It's an error to call Wait without a
+// prior, still-outstanding call to Start.
+func (p *Pipeline) Wait() (*PipelineResult, error) {
+	proc := p.proc
+	if proc == nil {
+		return nil, errors.New("pipeline: Wait called without a matching Start")
+	}
+	p.proc = nil
+
+	cStatuses := make([]C.CommandStatus, len(p.commands))
+	C.execute_pipeline_wait(proc.cCommands[0], (*C.CommandStatus)(unsafe.Pointer(&cStatuses[0])))
+	close(proc.cancelDone)
+
+	C.free_pipeline(proc.cCommands[0])
+	proc.allocs.free()
+	wiringErr := proc.w.wait()
+	proc.w.close()
+
+	return p.collectResult(cStatuses, proc.ctx, wiringErr)
+}
+
+// buildCommandNodes marshals p.commands into a NULL-terminated, linked array
+// of C.CommandNodes, registering every C allocation it makes in allocs and
+// every per-command stdin/stderr redirection it wires up in w.
+func (p *Pipeline) buildCommandNodes(allocs *cgoAllocs, w *ioWiring) ([]*C.CommandNode, error) {
+	if len(p.commands) == 0 {
+		return nil, errors.New("no commands in pipeline")
+	}
+
+	cCommands := make([]*C.CommandNode, len(p.commands)+1)
+	for i, cmd := range p.commands {
+		if len(cmd.args) == 0 {
+			return nil, errors.New("pipeline: command has no arguments")
+		}
+
+		argv := allocs.addArgv(C.pipeline_alloc_argv(C.int(len(cmd.args))))
+		for j, arg := range cmd.args {
+			C.pipeline_set_arg(argv, C.int(j), allocs.addCString(C.CString(arg)))
+		}
+
+		node := C.create_command_node(argv)
+
+		if cmd.env != nil {
+			envp := allocs.addArgv(C.pipeline_alloc_argv(C.int(len(cmd.env))))
+			for j, kv := range cmd.env {
+				C.pipeline_set_arg(envp, C.int(j), allocs.addCString(C.CString(kv)))
+			}
+			node.envp = envp
+		}
+
+		node.stdin_fd = C.int(-1)
+		if cmd.stdin != nil {
+			fd, err := w.readerFd(cmd.stdin)
+			if err != nil {
+				return nil, err
+			}
+			node.stdin_fd = C.int(fd)
+		}
+
+		node.stderr_fd = C.int(-1)
+		if cmd.stderr != nil {
+			fd, err := w.writerFd(cmd.stderr)
+			if err != nil {
+				return nil, err
+			}
+			node.stderr_fd = C.int(fd)
+		}
+
+		cCommands[i] = node
+	}
+	// cCommands[len(p.commands)] is already nil, NULL-terminating the array.
+
+	return cCommands, nil
+}
+
+// watchCancellation spawns the goroutine that signals pgid's process group
+// when ctx is done, escalating from SIGTERM to SIGKILL after
+// SetCancelGracePeriod. It returns a non-nil ctx (defaulting to
+// context.Background()) and a channel the caller must close once the
+// pipeline has been waited on, to let the goroutine exit.
+func (p *Pipeline) watchCancellation(ctx context.Context, pgid C.int) (context.Context, chan struct{}) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			C.pipeline_signal(pgid, C.int(syscall.SIGTERM))
+			timer := time.NewTimer(p.cancelGracePeriod())
+			defer timer.Stop()
+			select {
+			case <-done:
+			case <-timer.C:
+				C.pipeline_signal(pgid, C.int(syscall.SIGKILL))
+			}
+		}
+	}()
+	return ctx, done
+}
+
+// collectResult converts cStatuses into a *PipelineResult and decides what
+// error, if any, to return alongside it: ctx's error if it was canceled,
+// then wiringErr if copying to/from the caller's stdin/stdout/stderr failed,
+// otherwise an *ExitError per checkResult's SetPipeFail semantics.
+func (p *Pipeline) collectResult(cStatuses []C.CommandStatus, ctx context.Context, wiringErr error) (*PipelineResult, error) {
+	result := &PipelineResult{Statuses: make([]CommandStatus, len(p.commands))}
+	for i, cs := range cStatuses {
+		result.Statuses[i] = CommandStatus{
+			Pid:      int(cs.pid),
+			Args:     p.commands[i].args,
+			Exited:   cs.exited != 0,
+			ExitCode: int(cs.exit_code),
+			Signaled: cs.signaled != 0,
+			Signal:   int(cs.term_sig),
+		}
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return result, ctxErr
+	}
+
+	if wiringErr != nil {
+		return result, wiringErr
+	}
+
+	if err := checkResult(result, p.pipeFail); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,458 @@
+//go:build !cgo
+
+package pipline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// This file is the pure-Go counterpart of pipeline.go: it implements the
+// same Pipeline/Command API on top of os/exec instead of pipeline.c, so
+// that binaries that can't or don't want to cgo-link (cross-compiling,
+// CGO_ENABLED=0, static builds) still get a working package.
+
+// defaultCancelGracePeriod is how long RunWithIO waits after sending SIGTERM
+// to a canceled pipeline's process group before escalating to SIGKILL.
+const defaultCancelGracePeriod = 5 * time.Second
+
+// Command represents a command in the pipeline.
+type Command struct {
+	args   []string
+	env    []string
+	stdin  io.Reader
+	stderr io.Writer
+}
+
+// Pipeline represents a sequence of commands.
+type Pipeline struct {
+	commands    []*Command
+	pipeFail    bool
+	cancelGrace time.Duration
+
+	// stdoutPipeW and stderrPipeW are the write ends of the pipes created by
+	// StdoutPipe/StderrPipe, handed to the last command's Stdout/Stderr by
+	// Start.
+	stdoutPipeW *os.File
+	stderrPipeW *os.File
+
+	proc *runningPipeline
+}
+
+// runningPipeline holds the state of a Start call that Wait needs to finish
+// the pipeline off. Exists only between Start and Wait.
+type runningPipeline struct {
+	cmds        []*exec.Cmd
+	pipeWriters []*io.PipeWriter
+	pgid        int
+	ctx         context.Context
+	cancelDone  chan struct{}
+}
+
+// NewCommand creates a new Command with the given arguments.
+func NewCommand(args []string) *Command {
+	return &Command{args: args}
+}
+
+// SetStdin feeds r to this command's stdin, overriding whatever the
+// previous stage in the pipeline would otherwise have piped into it (or, for
+// the first command, the stdin passed to RunWithIO).
+func (c *Command) SetStdin(r io.Reader) *Command {
+	c.stdin = r
+	return c
+}
+
+// SetStderr redirects this command's stderr to w instead of the pipeline's
+// shared stderr.
+func (c *Command) SetStderr(w io.Writer) *Command {
+	c.stderr = w
+	return c
+}
+
+// SetEnv sets this command's environment as "KEY=VALUE" pairs. If unset, the
+// command inherits the calling process's environment.
+func (c *Command) SetEnv(env []string) *Command {
+	c.env = env
+	return c
+}
+
+// NewPipeline creates a new Pipeline.
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+// AddCommand adds a command to the pipeline.
+func (p *Pipeline) AddCommand(cmd *Command) *Pipeline {
+	p.commands = append(p.commands, cmd)
+	return p
+}
+
+// SetPipeFail controls how RunWithIO (and Run) decide whether the pipeline
+// failed. When true, the pipeline fails if any command exits non-zero
+// (bash's `set -o pipefail`); when false (the default), only the last
+// command's exit status matters.
+func (p *Pipeline) SetPipeFail(pipeFail bool) *Pipeline {
+	p.pipeFail = pipeFail
+	return p
+}
+
+// SetCancelGracePeriod controls how long RunWithIO waits after sending
+// SIGTERM to a canceled pipeline's process group before escalating to
+// SIGKILL. Defaults to 5 seconds.
+func (p *Pipeline) SetCancelGracePeriod(d time.Duration) *Pipeline {
+	p.cancelGrace = d
+	return p
+}
+
+func (p *Pipeline) cancelGracePeriod() time.Duration {
+	if p.cancelGrace > 0 {
+		return p.cancelGrace
+	}
+	return defaultCancelGracePeriod
+}
+
+// StdoutPipe returns a pipe connected to the last command's stdout. The
+// pipeline does not start writing to it until Start is called, and the
+// returned pipe should be read to EOF before calling Wait, as with
+// os/exec.Cmd.StdoutPipe. Unlike os/exec, Wait does not close the returned
+// pipe; the caller closes it. It's an error to call StdoutPipe after Start,
+// or more than once.
+func (p *Pipeline) StdoutPipe() (io.ReadCloser, error) {
+	if p.proc != nil {
+		return nil, errors.New("pipeline: StdoutPipe called after Start")
+	}
+	if p.stdoutPipeW != nil {
+		return nil, errors.New("pipeline: StdoutPipe called twice")
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stdoutPipeW = pw
+	return pr, nil
+}
+
+// StderrPipe is StdoutPipe for the last command's stderr.
+func (p *Pipeline) StderrPipe() (io.ReadCloser, error) {
+	if p.proc != nil {
+		return nil, errors.New("pipeline: StderrPipe called after Start")
+	}
+	if p.stderrPipeW != nil {
+		return nil, errors.New("pipeline: StderrPipe called twice")
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stderrPipeW = pw
+	return pr, nil
+}
+
+// Run executes the pipeline and captures the output of the last command.
+// Redirect stdout to outputFd. If its -1, output is not redirected.
+func (p *Pipeline) Run(outputFd int) (*PipelineResult, error) {
+	var stdout io.Writer
+	if outputFd >= 0 {
+		stdout = os.NewFile(uintptr(outputFd), "pipeline-output")
+	}
+	return p.RunWithIO(context.Background(), nil, stdout, nil)
+}
+
+// RunContext is Run plus cancellation: if ctx is done before the pipeline
+// finishes, every command in it (they all share one process group) is sent
+// SIGTERM, escalating to SIGKILL after SetCancelGracePeriod elapses.
+func (p *Pipeline) RunContext(ctx context.Context, outputFd int) (*PipelineResult, error) {
+	var stdout io.Writer
+	if outputFd >= 0 {
+		stdout = os.NewFile(uintptr(outputFd), "pipeline-output")
+	}
+	return p.RunWithIO(ctx, nil, stdout, nil)
+}
+
+// RunWithIO executes the pipeline, feeding stdin to the first command and
+// capturing the last command's stdout and stderr. Any of stdin, stdout or
+// stderr may be nil, in which case that stream is left connected to the
+// calling process's own stdin/stdout/stderr.
+//
+// The returned *PipelineResult is always populated, even when the error is
+// non-nil, so callers can inspect every command's exit status. The error is
+// a *ExitError when the pipeline itself ran but failed per SetPipeFail's
+// semantics.
+//
+// RunWithIO errors immediately if StdoutPipe or StderrPipe was called on p:
+// that output already has a dedicated reader, so continue with Start/Wait
+// instead of Run/RunWithIO.
+func (p *Pipeline) RunWithIO(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (*PipelineResult, error) {
+	if p.stdoutPipeW != nil || p.stderrPipeW != nil {
+		return nil, errors.New("pipeline: StdoutPipe/StderrPipe was called; use Start/Wait instead of Run/RunWithIO")
+	}
+
+	cmds, pipeWriters, err := p.buildCmds(stdin, stdout, stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	pgid, err := startCmds(cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancelDone := p.watchCancellation(ctx, pgid)
+
+	statuses := waitCmds(p.commands, cmds, pipeWriters)
+	close(cancelDone)
+
+	return p.collectResult(statuses, ctx)
+}
+
+// Start begins running the pipeline and returns immediately, without
+// waiting for it to finish. stdin, if non-nil, is fed to the first command.
+// The last command's stdout and stderr go to whatever StdoutPipe/StderrPipe
+// returned, or are left connected to the calling process's own stdout/stderr
+// if those weren't called. Every started pipeline must be followed by
+// exactly one call to Wait to release the resources Start allocates.
+func (p *Pipeline) Start(ctx context.Context, stdin io.Reader) error {
+	if p.proc != nil {
+		return errors.New("pipeline: already started")
+	}
+
+	cmds, pipeWriters, err := p.buildCmds(stdin, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	pgid, err := startCmds(cmds)
+	if err != nil {
+		return err
+	}
+
+	// The children have inherited their own copies of the pipe fds now, so
+	// the parent's copies must close for a StdoutPipe/StderrPipe reader to
+	// ever see EOF.
+	if p.stdoutPipeW != nil {
+		p.stdoutPipeW.Close()
+		p.stdoutPipeW = nil
+	}
+	if p.stderrPipeW != nil {
+		p.stderrPipeW.Close()
+		p.stderrPipeW = nil
+	}
+
+	ctx, cancelDone := p.watchCancellation(ctx, pgid)
+	p.proc = &runningPipeline{cmds: cmds, pipeWriters: pipeWriters, pgid: pgid, ctx: ctx, cancelDone: cancelDone}
+	return nil
+}
+
+// Wait blocks until a pipeline started with Start finishes, then releases
+// every resource Start allocated. It's an error to call Wait without a
+// prior, still-outstanding call to Start.
+func (p *Pipeline) Wait() (*PipelineResult, error) {
+	proc := p.proc
+	if proc == nil {
+		return nil, errors.New("pipeline: Wait called without a matching Start")
+	}
+	p.proc = nil
+
+	statuses := waitCmds(p.commands, proc.cmds, proc.pipeWriters)
+	close(proc.cancelDone)
+
+	return p.collectResult(statuses, proc.ctx)
+}
+
+// buildCmds wires p.commands into a chain of *exec.Cmd, piping each
+// command's stdout into the next one's stdin via io.Pipe unless that
+// command has its own SetStdin override. stdin, stdout and stderr behave
+// like RunWithIO's parameters of the same name; pass nil, nil for stdout and
+// stderr when StdoutPipe/StderrPipe (or plain inheritance) should apply
+// instead.
+//
+// The returned pipeWriters has one entry per gap between adjacent commands
+// (so len(cmds)-1 entries); pipeWriters[i] is the write end feeding
+// cmds[i+1]'s stdin, or nil if that gap used io.Discard instead. waitCmds
+// must close it once cmds[i] exits, or the next command never sees EOF on
+// its stdin: unlike an OS pipe, io.Pipe has no internal buffer and nothing
+// closes it automatically when a plain io.Writer is assigned to Cmd.Stdout.
+func (p *Pipeline) buildCmds(stdin io.Reader, stdout, stderr io.Writer) ([]*exec.Cmd, []*io.PipeWriter, error) {
+	if len(p.commands) == 0 {
+		return nil, nil, errors.New("no commands in pipeline")
+	}
+
+	cmds := make([]*exec.Cmd, len(p.commands))
+	for i, cmd := range p.commands {
+		if len(cmd.args) == 0 {
+			return nil, nil, errors.New("pipeline: command has no arguments")
+		}
+
+		ec := exec.Command(cmd.args[0], cmd.args[1:]...)
+		if cmd.env != nil {
+			ec.Env = cmd.env
+		}
+		cmds[i] = ec
+	}
+
+	first := p.commands[0]
+	switch {
+	case first.stdin != nil:
+		cmds[0].Stdin = first.stdin
+	case stdin != nil:
+		cmds[0].Stdin = stdin
+	default:
+		cmds[0].Stdin = os.Stdin
+	}
+
+	pipeWriters := make([]*io.PipeWriter, len(cmds)-1)
+	for i := 0; i < len(cmds)-1; i++ {
+		if p.commands[i+1].stdin != nil {
+			// The next command ignores what this one writes; let it drain
+			// instead of piping into a reader nobody will read from.
+			cmds[i].Stdout = io.Discard
+			cmds[i+1].Stdin = p.commands[i+1].stdin
+			continue
+		}
+		pr, pw := io.Pipe()
+		cmds[i].Stdout = pw
+		cmds[i+1].Stdin = pr
+		pipeWriters[i] = pw
+	}
+
+	for i := 0; i < len(cmds)-1; i++ {
+		if p.commands[i].stderr != nil {
+			cmds[i].Stderr = p.commands[i].stderr
+		} else {
+			cmds[i].Stderr = os.Stderr
+		}
+	}
+
+	last := cmds[len(cmds)-1]
+	lastCmd := p.commands[len(p.commands)-1]
+	switch {
+	case lastCmd.stderr != nil:
+		last.Stderr = lastCmd.stderr
+	case p.stderrPipeW != nil:
+		last.Stderr = p.stderrPipeW
+	case stderr != nil:
+		last.Stderr = stderr
+	default:
+		last.Stderr = os.Stderr
+	}
+
+	switch {
+	case p.stdoutPipeW != nil:
+		last.Stdout = p.stdoutPipeW
+	case stdout != nil:
+		last.Stdout = stdout
+	default:
+		last.Stdout = os.Stdout
+	}
+
+	return cmds, pipeWriters, nil
+}
+
+// startCmds starts every command in order, joining them all into a single
+// process group (whose pgid equals the first command's pid) so a canceled
+// ctx can terminate the whole pipeline with one signal. If a later command
+// fails to start, every command already started is killed before returning.
+func startCmds(cmds []*exec.Cmd) (pgid int, err error) {
+	for i, ec := range cmds {
+		if i == 0 {
+			ec.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		} else {
+			ec.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: pgid}
+		}
+
+		if err := ec.Start(); err != nil {
+			for _, started := range cmds[:i] {
+				started.Process.Kill()
+			}
+			return 0, err
+		}
+
+		if i == 0 {
+			pgid = ec.Process.Pid
+		}
+	}
+	return pgid, nil
+}
+
+// waitCmds waits for every command to finish, in pipeline order, closing
+// the io.Pipe feeding the next command's stdin as soon as the one before it
+// exits so that next command actually sees EOF (see buildCmds). Errors from
+// Cmd.Wait are not surfaced here: a non-zero exit is reported through the
+// status and handled by checkResult, and an error copying to or from a
+// non-*os.File stdin/stdout/stderr is dropped (the cgo backend returns
+// such copy errors from RunWithIO and Wait).
+func waitCmds(commands []*Command, cmds []*exec.Cmd, pipeWriters []*io.PipeWriter) []CommandStatus {
+	statuses := make([]CommandStatus, len(cmds))
+	for i, ec := range cmds {
+		ec.Wait()
+		if i < len(pipeWriters) && pipeWriters[i] != nil {
+			pipeWriters[i].Close()
+		}
+
+		status := CommandStatus{Args: commands[i].args}
+		if ec.Process != nil {
+			status.Pid = ec.Process.Pid
+		}
+		if ws, ok := ec.ProcessState.Sys().(syscall.WaitStatus); ok {
+			status.Exited = ws.Exited()
+			if status.Exited {
+				status.ExitCode = ws.ExitStatus()
+			}
+			status.Signaled = ws.Signaled()
+			if status.Signaled {
+				status.Signal = int(ws.Signal())
+			}
+		}
+		statuses[i] = status
+	}
+	return statuses
+}
+
+// watchCancellation spawns the goroutine that signals pgid's process group
+// when ctx is done, escalating from SIGTERM to SIGKILL after
+// SetCancelGracePeriod. It returns a non-nil ctx (defaulting to
+// context.Background()) and a channel the caller must close once the
+// pipeline has been waited on, to let the goroutine exit.
+func (p *Pipeline) watchCancellation(ctx context.Context, pgid int) (context.Context, chan struct{}) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			syscall.Kill(-pgid, syscall.SIGTERM)
+			timer := time.NewTimer(p.cancelGracePeriod())
+			defer timer.Stop()
+			select {
+			case <-done:
+			case <-timer.C:
+				syscall.Kill(-pgid, syscall.SIGKILL)
+			}
+		}
+	}()
+	return ctx, done
+}
+
+// collectResult converts statuses into a *PipelineResult and decides what
+// error, if any, to return alongside it: ctx's error if it was canceled,
+// otherwise an *ExitError per checkResult's SetPipeFail semantics.
+func (p *Pipeline) collectResult(statuses []CommandStatus, ctx context.Context) (*PipelineResult, error) {
+	result := &PipelineResult{Statuses: statuses}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return result, ctxErr
+	}
+
+	if err := checkResult(result, p.pipeFail); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,187 @@
+package pipline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// These tests exercise the public Pipeline/Command API only, so the same
+// suite runs unmodified against both the cgo backend (pipeline.go) and the
+// pure-Go backend (pipeline_nocgo.go) depending on CGO_ENABLED.
+
+func TestPipelineRunWithIO(t *testing.T) {
+	p := NewPipeline().
+		AddCommand(NewCommand([]string{"echo", "hello world"})).
+		AddCommand(NewCommand([]string{"tr", "a-z", "A-Z"}))
+
+	var stdout bytes.Buffer
+	result, err := p.RunWithIO(context.Background(), nil, &stdout, nil)
+	if err != nil {
+		t.Fatalf("RunWithIO: %v", err)
+	}
+	if got, want := strings.TrimSpace(stdout.String()), "HELLO WORLD"; got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+	if !result.Last().Success() {
+		t.Fatalf("last command did not succeed: %+v", result.Last())
+	}
+}
+
+func TestPipelineRunWithIO_Stdin(t *testing.T) {
+	p := NewPipeline().AddCommand(NewCommand([]string{"cat"}))
+
+	var stdout bytes.Buffer
+	_, err := p.RunWithIO(context.Background(), strings.NewReader("piped in"), &stdout, nil)
+	if err != nil {
+		t.Fatalf("RunWithIO: %v", err)
+	}
+	if got, want := stdout.String(), "piped in"; got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+}
+
+func TestPipelineExitError(t *testing.T) {
+	p := NewPipeline().AddCommand(NewCommand([]string{"false"}))
+
+	result, err := p.RunWithIO(context.Background(), nil, nil, nil)
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("err = %v, want *ExitError", err)
+	}
+	if result.Last().Success() {
+		t.Fatalf("expected last command to fail")
+	}
+	if exitErr.Status.ExitCode != 1 {
+		t.Fatalf("ExitCode = %d, want 1", exitErr.Status.ExitCode)
+	}
+}
+
+func TestPipelineSetPipeFail(t *testing.T) {
+	p := NewPipeline().
+		AddCommand(NewCommand([]string{"false"})).
+		AddCommand(NewCommand([]string{"true"})).
+		SetPipeFail(true)
+
+	_, err := p.RunWithIO(context.Background(), nil, nil, nil)
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("err = %v, want *ExitError with PipeFail set", err)
+	}
+}
+
+func TestPipelineRunContext_Cancellation(t *testing.T) {
+	p := NewPipeline().AddCommand(NewCommand([]string{"sleep", "30"})).
+		SetCancelGracePeriod(50 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := p.RunWithIO(ctx, nil, nil, nil)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if elapsed > 5*time.Second {
+		t.Fatalf("pipeline took %v to die after cancellation, want well under sleep's 30s", elapsed)
+	}
+}
+
+func TestPipelineStdoutPipe(t *testing.T) {
+	p := NewPipeline().AddCommand(NewCommand([]string{"printf", "one\ntwo\nthree\n"}))
+
+	stdout, err := p.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	if err := p.Start(context.Background(), nil); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("scanning stdout: %v", err)
+	}
+
+	if _, err := p.Wait(); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+
+	want := []string{"one", "two", "three"}
+	if len(lines) != len(want) {
+		t.Fatalf("lines = %v, want %v", lines, want)
+	}
+	for i, line := range lines {
+		if line != want[i] {
+			t.Fatalf("lines[%d] = %q, want %q", i, line, want[i])
+		}
+	}
+}
+
+func TestPipelineNoCommands(t *testing.T) {
+	if _, err := NewPipeline().RunWithIO(context.Background(), nil, nil, nil); err == nil {
+		t.Fatal("expected an error running a pipeline with no commands")
+	}
+}
+
+func TestPipelineEmptyCommandArgs(t *testing.T) {
+	p := NewPipeline().AddCommand(NewCommand(nil))
+	if _, err := p.RunWithIO(context.Background(), nil, nil, nil); err == nil {
+		t.Fatal("expected an error running a command with no arguments")
+	}
+}
+
+func TestPipelineRunAfterStdoutPipe(t *testing.T) {
+	p := NewPipeline().AddCommand(NewCommand([]string{"echo", "hello"}))
+
+	if _, err := p.StdoutPipe(); err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	if _, err := p.RunWithIO(context.Background(), nil, nil, nil); err == nil {
+		t.Fatal("expected RunWithIO to reject a pipeline with StdoutPipe already called")
+	}
+}
+
+// TestPipelineNoLeaks runs a batch of pipelines back to back and checks that
+// goroutine count settles back down afterward, as an assertion that
+// RunWithIO's io-copy and cancellation goroutines aren't leaking across
+// calls. C allocations are not measured here.
+func TestPipelineNoLeaks(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		p := NewPipeline().
+			AddCommand(NewCommand([]string{"echo", "leak check"})).
+			AddCommand(NewCommand([]string{"cat"}))
+
+		var stdout bytes.Buffer
+		if _, err := p.RunWithIO(context.Background(), nil, &stdout, nil); err != nil {
+			t.Fatalf("RunWithIO: %v", err)
+		}
+	}
+
+	// Give any straggling goroutines a moment to unwind before sampling.
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		runtime.Gosched()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutine count grew from %d to %d after 50 runs", before, after)
+	}
+}
@@ -0,0 +1,64 @@
+package pipline
+
+import "fmt"
+
+// CommandStatus reports how a single command in a pipeline terminated.
+type CommandStatus struct {
+	Pid      int
+	Args     []string
+	Exited   bool
+	ExitCode int
+	Signaled bool
+	Signal   int
+}
+
+// Success reports whether the command exited with status 0.
+func (s CommandStatus) Success() bool {
+	return s.Exited && s.ExitCode == 0
+}
+
+// PipelineResult holds the status of every command run by a Pipeline, in
+// the order they were added.
+type PipelineResult struct {
+	Statuses []CommandStatus
+}
+
+// Last returns the status of the final command in the pipeline.
+func (r *PipelineResult) Last() CommandStatus {
+	return r.Statuses[len(r.Statuses)-1]
+}
+
+// ExitError reports that a command in a pipeline exited unsuccessfully,
+// mirroring the role os/exec.ExitError plays for a single command.
+type ExitError struct {
+	Result *PipelineResult
+	Status CommandStatus
+}
+
+func (e *ExitError) Error() string {
+	if e.Status.Signaled {
+		return fmt.Sprintf("pipeline: command %v killed by signal %d", e.Status.Args, e.Status.Signal)
+	}
+	return fmt.Sprintf("pipeline: command %v exited with code %d", e.Status.Args, e.Status.ExitCode)
+}
+
+// checkResult turns a PipelineResult into an *ExitError according to
+// pipeFail: when true, the first failing command in the pipeline (in
+// left-to-right order) fails the run, matching bash's `set -o pipefail`;
+// when false, only the last command's status is considered, matching plain
+// shell pipeline semantics.
+func checkResult(result *PipelineResult, pipeFail bool) error {
+	if pipeFail {
+		for _, status := range result.Statuses {
+			if !status.Success() {
+				return &ExitError{Result: result, Status: status}
+			}
+		}
+		return nil
+	}
+
+	if last := result.Last(); !last.Success() {
+		return &ExitError{Result: result, Status: last}
+	}
+	return nil
+}